@@ -1,22 +1,37 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/pborman/getopt"
 	"gopkg.in/src-d/go-git.v4"
-	"log"
+	"gopkg.in/src-d/go-git.v4/plumbing"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
 )
 
-func fatalf(fmt string, args ...interface{}) {
-	log.Fatalf("git-subtrac: "+fmt, args...)
+// activeLogger is set in main() once --log-format is known; fatalf uses it
+// so a fatal error is just another event, not a plain-text line a JSON
+// consumer has to special-case.
+var activeLogger Logger = NewTextLogger(os.Stderr, false)
+
+func fatalf(format string, args ...interface{}) {
+	msg := strings.TrimRight(fmt.Sprintf("git-subtrac: "+format, args...), "\n")
+	activeLogger.Log(LevelError, "fatal", Fields{"msg": msg})
+	os.Exit(1)
 }
 
 var usage_str = `
 Commands:
-    cid <ref>       Print the id of a tracking commit based on the given ref
-    dump <refs...>  Print the cache after loading the given branch ref(s)
-    update          Update all local branches with a matching *.trac branch
+    cid <ref>          Print the id of a tracking commit based on the given ref
+    dump <refs...>     Print the cache after loading the given branch ref(s)
+    update             Update all local branches with a matching *.trac branch
+    push <remote> [refs...]  Push local *.trac branches to a remote
+    fetch <remote>      Fetch peers' *.trac branches from a remote
+    verify <ref> [hash] Check <ref>.trac (or the given hash) matches the live tree
 `
 
 func usage() {
@@ -32,34 +47,48 @@ func usagef(format string, args ...interface{}) {
 }
 
 func main() {
-	log.SetFlags(0)
-	infof := log.Printf
-
 	getopt.SetUsage(usage)
 	repodir := getopt.StringLong("git-dir", 'd', ".", "path to git repo", "GIT_DIR")
 	excludes := getopt.ListLong("exclude", 'x', "commitids to exclude", "commitids...")
 	autoexclude := getopt.BoolLong("auto-exclude", 0, "auto exclude missing commits")
+	usealternates := getopt.BoolLong("use-alternates", 0, "resolve submodule commits via git alternates instead of fetching")
+	jobs := getopt.IntLong("jobs", 'j', runtime.NumCPU(), "number of concurrent workers", "N")
 	verbose := getopt.BoolLong("verbose", 'v', "verbose mode")
+	logFormat := getopt.StringLong("log-format", 0, "text", "log output format: text or json", "FORMAT")
 	getopt.Parse()
 
+	var logger Logger
+	switch *logFormat {
+	case "text":
+		logger = NewTextLogger(os.Stderr, *verbose)
+	case "json":
+		logger = NewJSONLogger(os.Stderr, *verbose)
+	default:
+		usagef("unknown --log-format %q (want text or json)", *logFormat)
+	}
+	activeLogger = logger
+
 	r, err := git.PlainOpen(*repodir)
 	if err != nil {
 		fatalf("git: %v: %v\n", repodir, err)
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		logger.Log(LevelWarn, "interrupted", Fields{"msg": "interrupted; unwinding..."})
+		cancel()
+	}()
+
 	args := getopt.Args()
 	if len(args) < 1 {
 		usagef("no command specified.")
 	}
 
-	var debugf func(fmt string, args ...interface{})
-	if *verbose {
-		debugf = infof
-	} else {
-		debugf = func(fmt string, args ...interface{}) {}
-	}
-
-	c, err := NewCache(*repodir, r, *excludes, *autoexclude, debugf, infof)
+	c, err := NewCache(ctx, *repodir, r, *excludes, *autoexclude, *usealternates, *jobs, logger)
 	if err != nil {
 		fatalf("NewCache: %v\n", err)
 	}
@@ -69,7 +98,7 @@ func main() {
 		if len(args) != 1 {
 			usagef("command 'update' takes no arguments")
 		}
-		err := c.UpdateBranchRefs()
+		err := c.UpdateBranchRefs(ctx)
 		if err != nil {
 			fatalf("%v\n", err)
 		}
@@ -78,17 +107,45 @@ func main() {
 			usagef("command 'cid' takes exactly 1 argument")
 		}
 		refname := args[1]
-		trac, err := c.TracByRef(refname)
+		trac, err := c.TracByRef(ctx, refname)
 		if err != nil {
 			fatalf("%v\n", err)
 		}
 		fmt.Printf("%v\n", trac.Hash)
+	case "push":
+		if len(args) < 2 {
+			usagef("command 'push' requires a remote name")
+		}
+		err := c.PushTracRefs(ctx, args[1], args[2:])
+		if err != nil {
+			fatalf("%v\n", err)
+		}
+	case "fetch":
+		if len(args) != 2 {
+			usagef("command 'fetch' takes exactly 1 argument")
+		}
+		err := c.FetchTracRefs(ctx, args[1])
+		if err != nil {
+			fatalf("%v\n", err)
+		}
+	case "verify":
+		if len(args) < 2 || len(args) > 3 {
+			usagef("command 'verify' takes 1 or 2 arguments")
+		}
+		want := plumbing.ZeroHash
+		if len(args) == 3 {
+			want = plumbing.NewHash(args[2])
+		}
+		err := c.VerifyRef(ctx, args[1], want)
+		if err != nil {
+			fatalf("%v\n", err)
+		}
 	case "dump":
 		if len(args) < 2 {
 			usagef("command 'dump' takes at least 1 argument")
 		}
 		for _, refname := range args[1:] {
-			_, err := c.TracByRef(refname)
+			_, err := c.TracByRef(ctx, refname)
 			if err != nil {
 				fatalf("%v\n", err)
 			}
@@ -97,4 +154,8 @@ func main() {
 	default:
 		usagef("unknown command %v", args[0])
 	}
+
+	if err := c.SaveDiskCache(); err != nil {
+		logger.Log(LevelWarn, "save_cache_failed", Fields{"msg": fmt.Sprintf("warning: %v", err)})
+	}
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Fields is a small set of key/value pairs attached to a single log event.
+// Callers should stick to a handful of stable names (branch, submodule,
+// hash, trac_hash, remote, ...) so a JSON consumer can rely on them
+// appearing consistently across events.
+type Fields map[string]interface{}
+
+// LogLevel orders subtrac's log events by severity.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Logger is a leveled, structured sink for subtrac's progress events (e.g.
+// "scanning branch X", "found submodule commit Y in Z"). A wrapping tool
+// (a CI job, a build-orchestrator) can consume these programmatically via
+// a JSON-emitting Logger instead of regex-scraping stderr.
+type Logger interface {
+	Log(level LogLevel, event string, fields Fields)
+}
+
+// textLogger renders events as plain human-readable lines, using the
+// "msg" field as the line if one was given. This is subtrac's default,
+// and matches its original debugf/infof-style output.
+type textLogger struct {
+	w       io.Writer
+	verbose bool
+}
+
+// NewTextLogger returns a Logger that writes one human-readable line per
+// event to w. Debug-level events are suppressed unless verbose is set.
+func NewTextLogger(w io.Writer, verbose bool) Logger {
+	return &textLogger{w: w, verbose: verbose}
+}
+
+func (l *textLogger) Log(level LogLevel, event string, fields Fields) {
+	if level == LevelDebug && !l.verbose {
+		return
+	}
+	if msg, ok := fields["msg"].(string); ok && msg != "" {
+		fmt.Fprintf(l.w, "%s\n", msg)
+		return
+	}
+	fmt.Fprintf(l.w, "%s\n", event)
+}
+
+// jsonLogger renders events as one JSON object per line, with stable
+// field names (event, level, plus whatever was passed in fields except
+// "msg", the text logger's human-readable line, which is left out) so
+// downstream tools can drive dashboards or fail-fast logic.
+type jsonLogger struct {
+	w       io.Writer
+	verbose bool
+}
+
+// NewJSONLogger returns a Logger that writes one JSON object per event to
+// w. Debug-level events are suppressed unless verbose is set.
+func NewJSONLogger(w io.Writer, verbose bool) Logger {
+	return &jsonLogger{w: w, verbose: verbose}
+}
+
+func (l *jsonLogger) Log(level LogLevel, event string, fields Fields) {
+	if level == LevelDebug && !l.verbose {
+		return
+	}
+	out := make(map[string]interface{}, len(fields)+2)
+	for k, v := range fields {
+		if k == "msg" {
+			continue
+		}
+		out[k] = v
+	}
+	out["event"] = event
+	out["level"] = level.String()
+	b, err := json.Marshal(out)
+	if err != nil {
+		fmt.Fprintf(l.w, `{"event":"log_error","level":"error"}`+"\n")
+		return
+	}
+	fmt.Fprintf(l.w, "%s\n", b)
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/config"
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // A Trac represents a commit or tree somewhere in the project's hierarchy,
@@ -41,28 +45,46 @@ func (t Trac) String() string {
 }
 
 type Cache struct {
-	debugf      func(fmt string, args ...interface{})
-	infof       func(fmt string, args ...interface{})
-	repoDir     string                  // toplevel repo dir
-	repo        *git.Repository         // open copy of the toplevel repo
-	autoexclude bool                    // --auto-exclude enabled
-	excludes    map[plumbing.Hash]bool  // specifically excluded objects
-	tracs       map[plumbing.Hash]*Trac // object lookup cache
-	srPaths     []string                // subrepo paths cache
-	srRepos     []*git.Repository       // subrepo object cache
+	logger         Logger
+	repoDir        string                  // toplevel repo dir
+	repo           *git.Repository         // open copy of the toplevel repo
+	autoexclude    bool                    // --auto-exclude enabled
+	useAlternates  bool                    // --use-alternates enabled
+	excludes       map[plumbing.Hash]bool  // specifically excluded objects
+	mu             sync.Mutex              // guards tracs, newTracs, excludes, srPaths, srRepos
+	tracs          map[plumbing.Hash]*Trac // object lookup cache
+	newTracs       []*Trac                 // entries computed this run, pending disk-cache save
+	sem            chan struct{}           // bounds concurrent object-store reads
+	srPaths        []string                // subrepo paths cache
+	srRepos        []*git.Repository       // subrepo object cache
+	altOnce        sync.Once               // guards registerAlternates
+	altErr         error                   // result of registerAlternates
+	diskCacheStale bool                    // on-disk cache missing/invalidated; rewrite rather than append
 }
 
-func NewCache(rdir string, r *git.Repository, excludes []string,
-	autoexclude bool,
-	debugf, infof func(fmt string, args ...interface{})) (*Cache, error) {
+// Convenience wrappers so call sites don't need to name the level/Cache
+// explicitly every time.
+func (c *Cache) debug(event string, fields Fields) { c.logger.Log(LevelDebug, event, fields) }
+func (c *Cache) info(event string, fields Fields)  { c.logger.Log(LevelInfo, event, fields) }
+func (c *Cache) warn(event string, fields Fields)  { c.logger.Log(LevelWarn, event, fields) }
+
+func NewCache(ctx context.Context, rdir string, r *git.Repository, excludes []string,
+	autoexclude, useAlternates bool, jobs int, logger Logger) (*Cache, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
 	c := Cache{
-		debugf:      debugf,
-		infof:       infof,
-		repoDir:     rdir,
-		repo:        r,
-		autoexclude: autoexclude,
-		excludes:    make(map[plumbing.Hash]bool),
-		tracs:       make(map[plumbing.Hash]*Trac),
+		logger:        logger,
+		repoDir:       rdir,
+		repo:          r,
+		autoexclude:   autoexclude,
+		useAlternates: useAlternates,
+		excludes:      make(map[plumbing.Hash]bool),
+		tracs:         make(map[plumbing.Hash]*Trac),
+		sem:           make(chan struct{}, jobs),
 	}
 
 	for _, x := range excludes {
@@ -97,14 +119,196 @@ func NewCache(rdir string, r *git.Repository, excludes []string,
 		}
 	}
 
+	if err := c.loadDiskCache(); err != nil {
+		return nil, err
+	}
+
 	return &c, nil
 }
 
+// Path to the persistent trac cache. Git hashes are content-addressed, so
+// an entry's meaning never changes -- but which entries are valid at all
+// depends on the active --exclude/--auto-exclude/.trac-excludes set, so the
+// file is invalidated (see excludesFingerprint) whenever that changes.
+func (c *Cache) diskCachePath() string {
+	return filepath.Join(c.repoDir, ".git", "subtrac", "cache.db")
+}
+
+// cacheHeaderPrefix marks the first line of the cache file, which records
+// the exclude set the rest of the file was computed under.
+const cacheHeaderPrefix = "excludes "
+
+// A stable fingerprint of the currently active exclude set. Two runs with
+// the same fingerprint agree on which commits are excluded, so one run's
+// cache entries are safe for the other to reuse.
+func (c *Cache) excludesFingerprint() string {
+	c.mu.Lock()
+	hashes := make([]string, 0, len(c.excludes))
+	for h := range c.excludes {
+		hashes = append(hashes, h.String())
+	}
+	c.mu.Unlock()
+	sort.Strings(hashes)
+	return strings.Join(hashes, ",")
+}
+
+// Populate c.tracs with lightweight entries from a previous run's disk
+// cache, if one exists and was computed under the same exclude set. Each
+// entry records the real tree/commit hash, the synthetic tracCommit hash it
+// produced (if any), and the hashes of its direct subHeads; we resolve
+// those back into *Trac pointers (and the tracCommit hash back into an
+// *object.Commit) in a second pass, since entries may reference each other
+// in either order in the file.
+func (c *Cache) loadDiskCache() error {
+	f, err := os.Open(c.diskCachePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			c.diskCacheStale = true
+			return nil
+		}
+		return fmt.Errorf("subtrac cache: %v", err)
+	}
+	defer f.Close()
+
+	type pending struct {
+		trac     *Trac
+		tracHash plumbing.Hash
+		subs     []plumbing.Hash
+	}
+	var all []pending
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != cacheHeaderPrefix+c.excludesFingerprint() {
+		// Either this cache predates the header, or it was written under
+		// a different exclude set. Its entries reflect which commits
+		// were reachable under that other configuration, so none of
+		// them can be trusted now; start cold and let SaveDiskCache
+		// rewrite the file from scratch.
+		c.info("cache_invalidated", Fields{
+			"msg": "subtrac cache: exclude set changed (or no cache yet); ignoring disk cache"})
+		c.diskCacheStale = true
+		return nil
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, " ")
+		if len(fields) != 3 {
+			c.debug("cache_skip_line", Fields{"msg": fmt.Sprintf("subtrac cache: skipping malformed line %q", line)})
+			continue
+		}
+		hash := plumbing.NewHash(fields[0])
+		if c.tracs[hash] != nil {
+			continue
+		}
+		trac := &Trac{hash: hash}
+		var subs []plumbing.Hash
+		if fields[2] != "-" {
+			for _, s := range strings.Split(fields[2], ",") {
+				subs = append(subs, plumbing.NewHash(s))
+			}
+		}
+		c.tracs[hash] = trac
+		all = append(all, pending{trac, plumbing.NewHash(fields[1]), subs})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("subtrac cache: %v", err)
+	}
+
+	// First resolve each entry's own tracHash, dropping any entry whose
+	// tracHash doesn't resolve -- e.g. a tracCommit written by cid/dump,
+	// which never gets a ref pointed at it and so can be pruned by a git
+	// gc. Kept with tracCommit left nil, such an entry would look like one
+	// with genuinely no submodules (whose tracHash is the zero hash) while
+	// still listing real subs; rather than guess, drop it from c.tracs
+	// entirely so tracCommit/tracTree recompute it fresh.
+	for _, p := range all {
+		if p.tracHash == plumbing.ZeroHash {
+			continue
+		}
+		if tc, err := c.repo.CommitObject(p.tracHash); err == nil {
+			p.trac.tracCommit = tc
+		} else {
+			delete(c.tracs, p.trac.hash)
+		}
+	}
+
+	for _, p := range all {
+		if c.tracs[p.trac.hash] != p.trac {
+			continue // dropped above
+		}
+		for _, h := range p.subs {
+			if sub := c.tracs[h]; sub != nil {
+				p.trac.subHeads = append(p.trac.subHeads, sub)
+			}
+		}
+	}
+	return nil
+}
+
+// Append the entries computed during this run to the persistent trac
+// cache, so a future invocation doesn't have to recompute them. If the
+// on-disk cache was invalidated (or didn't exist) at load time, the file is
+// rewritten from scratch with a fresh header instead of appended to, since
+// whatever was there before was never loaded and can't be trusted to still
+// apply.
+func (c *Cache) SaveDiskCache() error {
+	c.mu.Lock()
+	newTracs := c.newTracs
+	c.newTracs = nil
+	c.mu.Unlock()
+
+	if len(newTracs) == 0 && !c.diskCacheStale {
+		return nil
+	}
+
+	path := c.diskCachePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return fmt.Errorf("subtrac cache: %v", err)
+	}
+	flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	if c.diskCacheStale {
+		flags = os.O_TRUNC | os.O_CREATE | os.O_WRONLY
+	}
+	f, err := os.OpenFile(path, flags, 0666)
+	if err != nil {
+		return fmt.Errorf("subtrac cache: %v", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if c.diskCacheStale {
+		fmt.Fprintf(w, "%s%s\n", cacheHeaderPrefix, c.excludesFingerprint())
+		c.diskCacheStale = false
+	}
+	for _, trac := range newTracs {
+		tracHash := plumbing.ZeroHash
+		if trac.tracCommit != nil {
+			tracHash = trac.tracCommit.Hash
+		}
+		var subs []string
+		for _, h := range trac.subHeads {
+			subs = append(subs, h.hash.String())
+		}
+		substr := "-"
+		if len(subs) > 0 {
+			substr = strings.Join(subs, ",")
+		}
+		fmt.Fprintf(w, "%v %v %v\n", trac.hash, tracHash, substr)
+	}
+	return w.Flush()
+}
+
 func (c *Cache) String() string {
+	c.mu.Lock()
 	var l []*Trac
 	for _, v := range c.tracs {
 		l = append(l, v)
 	}
+	c.mu.Unlock()
 
 	sort.Slice(l, func(i, j int) bool {
 		return l[i].name < l[j].name
@@ -117,15 +321,39 @@ func (c *Cache) String() string {
 	return strings.Join(out, "\n")
 }
 
-// Add one commit to the exclusion list.
+// Add one commit to the exclusion list. May be called concurrently by
+// tracTreeEntry's worker-pool goroutines, so it's guarded the same as
+// c.tracs.
 func (c *Cache) exclude(hash plumbing.Hash) {
-	if !c.excludes[hash] {
-		c.excludes[hash] = true
-	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.excludes[hash] = true
+}
+
+// Locked lookup into c.excludes, for the same reason as getTrac.
+func (c *Cache) isExcluded(hash plumbing.Hash) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.excludes[hash]
+}
+
+// Reserve and release a slot in the worker pool, so at most --jobs
+// goroutines are reading from the object store at once. The number of
+// goroutines walking the commit+tree DAG is not bounded: tracCommit and
+// tracTree start one per parent or tree entry.
+func (c *Cache) acquire() { c.sem <- struct{}{} }
+func (c *Cache) release() { <-c.sem }
+
+// Locked lookup into c.tracs, since tracCommit/tracTree may now be
+// called concurrently by multiple workers.
+func (c *Cache) getTrac(hash plumbing.Hash) *Trac {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tracs[hash]
 }
 
 // Load all branches into the cache, and update a .trac ref for each one.
-func (c *Cache) UpdateBranchRefs() error {
+func (c *Cache) UpdateBranchRefs(ctx context.Context) error {
 	branchIter, err := c.repo.Branches()
 	if err != nil {
 		return fmt.Errorf("GetBranches: %v", err)
@@ -134,16 +362,20 @@ func (c *Cache) UpdateBranchRefs() error {
 	var branches []*plumbing.Reference
 	var commits []*object.Commit
 	err = branchIter.ForEach(func(b *plumbing.Reference) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		name := string(b.Name())
 		if strings.HasSuffix(name, ".trac") {
 			return nil
 		}
-		c.infof("Scanning branch: %v\n", name)
-		commit, err := c.TracByRef(name)
+		c.info("scan_branch", Fields{"branch": name, "msg": fmt.Sprintf("Scanning branch: %v", name)})
+		commit, err := c.TracByRef(ctx, name)
 		if err != nil {
 			return err
 		} else if commit == nil {
-			c.infof("Warning: no submodule commits found for %v; skipping.\n", name)
+			c.warn("no_submodules", Fields{"branch": name,
+				"msg": fmt.Sprintf("Warning: no submodule commits found for %v; skipping.", name)})
 		} else {
 			branches = append(branches, b)
 			commits = append(commits, commit)
@@ -158,10 +390,14 @@ func (c *Cache) UpdateBranchRefs() error {
 	}
 
 	for i := range branches {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		newname := string(branches[i].Name()) + ".trac"
 		cc := commits[i]
 		hash := cc.Hash
-		c.infof("Updating %.10v -> %v\n", hash, newname)
+		c.info("update_ref", Fields{"branch": newname, "trac_hash": hash.String(),
+			"msg": fmt.Sprintf("Updating %.10v -> %v", hash, newname)})
 
 		refname := plumbing.ReferenceName(newname)
 		ref := plumbing.NewHashReference(refname, hash)
@@ -175,7 +411,10 @@ func (c *Cache) UpdateBranchRefs() error {
 }
 
 // Generate a synthetic commit for the given ref.
-func (c *Cache) TracByRef(refname string) (*object.Commit, error) {
+func (c *Cache) TracByRef(ctx context.Context, refname string) (*object.Commit, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	h, err := c.repo.ResolveRevision(plumbing.Revision(refname))
 	if err != nil {
 		return nil, fmt.Errorf("%v: %v", refname, err)
@@ -184,13 +423,104 @@ func (c *Cache) TracByRef(refname string) (*object.Commit, error) {
 	if err != nil {
 		return nil, fmt.Errorf("%v: %v", refname, err)
 	}
-	tc, err := c.tracCommit(refname, commit)
+	tc, err := c.tracCommit(ctx, refname, commit)
 	if err != nil || tc == nil {
 		return nil, err
 	}
 	return tc.tracCommit, nil
 }
 
+// Recompute the synthetic trac commit for refname, without updating any
+// ref, and check its hash against either want (if not the zero hash) or
+// refname+".trac"'s current value. Synthetic commits that had to be
+// computed are still stored in the object store, as tracCommit always does.
+// It then walks refname's own commit history and reports every submodule
+// commit that a commit along it records directly but that is missing from
+// the repo's object store. Submodule commits recorded only inside other
+// submodules are not checked.
+func (c *Cache) VerifyRef(ctx context.Context, refname string, want plumbing.Hash) error {
+	h, err := c.repo.ResolveRevision(plumbing.Revision(refname))
+	if err != nil {
+		return fmt.Errorf("%v: %v", refname, err)
+	}
+	commit, err := c.repo.CommitObject(*h)
+	if err != nil {
+		return fmt.Errorf("%v: %v", refname, err)
+	}
+
+	trac, err := c.tracCommit(ctx, refname, commit)
+	if err != nil {
+		return err
+	}
+	if trac == nil || trac.tracCommit == nil {
+		return fmt.Errorf("%v: no submodule commits found; nothing to verify", refname)
+	}
+
+	if want == plumbing.ZeroHash {
+		tracRef := refname + ".trac"
+		th, err := c.repo.ResolveRevision(plumbing.Revision(tracRef))
+		if err != nil {
+			return fmt.Errorf("%v: %v (run 'update' first, or pass a hash explicitly)", tracRef, err)
+		}
+		want = *th
+	}
+	if trac.tracCommit.Hash != want {
+		return fmt.Errorf("%v: trac commit mismatch: computed %.10v, expected %.10v",
+			refname, trac.tracCommit.Hash, want)
+	}
+
+	// Walk the real commit DAG via CommitObject.ParentHashes, not
+	// Trac.parents: a Trac loaded from the on-disk cache (chunk0-4) only
+	// ever has subHeads populated, never parents, so walking Trac.parents
+	// would silently stop at the first warm-cache hit instead of
+	// continuing back through history.
+	var missing []plumbing.Hash
+	seen := make(map[plumbing.Hash]bool)
+	var walk func(h plumbing.Hash) error
+	walk = func(h plumbing.Hash) error {
+		if seen[h] {
+			return nil
+		}
+		seen[h] = true
+
+		cm, err := c.repo.CommitObject(h)
+		if err != nil {
+			return fmt.Errorf("%.10v: %v", h, err)
+		}
+
+		t := c.getTrac(h)
+		if t == nil {
+			if t, err = c.tracCommit(ctx, h.String(), cm); err != nil {
+				return err
+			}
+		}
+		for _, sh := range t.subHeads {
+			if _, err := c.repo.CommitObject(sh.hash); err != nil {
+				missing = append(missing, sh.hash)
+			}
+		}
+
+		for _, p := range cm.ParentHashes {
+			if err := walk(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(commit.Hash); err != nil {
+		return err
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("%v: %d submodule commit(s) not reachable: %v",
+			refname, len(missing), missing)
+	}
+
+	c.info("verify_ok", Fields{"branch": refname, "trac_hash": trac.tracCommit.Hash.String(),
+		"msg": fmt.Sprintf("%v: OK (%.10v)", refname, trac.tracCommit.Hash)})
+	return nil
+}
+
 // Starting at the given commit, load all its recursive parents and
 // submodule references into the cache, returning the cache entry.
 //
@@ -200,8 +530,11 @@ func (c *Cache) TracByRef(refname string) (*object.Commit, error) {
 // Mercifully, git's content-addressable storage means there are never
 // any cycles when traversing the commit+submodule hierarchy, although the
 // same sub-objects may occur many times at different points in the tree.
-func (c *Cache) tracCommit(path string, commit *object.Commit) (*Trac, error) {
-	trac := c.tracs[commit.Hash]
+func (c *Cache) tracCommit(ctx context.Context, path string, commit *object.Commit) (*Trac, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	trac := c.getTrac(commit.Hash)
 	if trac != nil {
 		return trac, nil
 	}
@@ -213,7 +546,7 @@ func (c *Cache) tracCommit(path string, commit *object.Commit) (*Trac, error) {
 	if err != nil {
 		return nil, fmt.Errorf("%v:%.10v: %v", path, commit.Hash, err)
 	}
-	ttrac, err := c.tracTree(path+"/", tree)
+	ttrac, err := c.tracTree(ctx, path+"/", tree)
 	if err != nil {
 		return nil, err
 	}
@@ -222,18 +555,49 @@ func (c *Cache) tracCommit(path string, commit *object.Commit) (*Trac, error) {
 	// owned by the commit.
 	trac.subHeads = ttrac.subHeads
 
+	// Walk each parent on its own worker; parents are independent
+	// subtrees of the DAG, so this is the main source of parallelism
+	// for wide histories with many merge commits.
+	parents := make([]*Trac, len(commit.ParentHashes))
+	errs := make([]error, len(commit.ParentHashes))
+	var wg sync.WaitGroup
 	for i, parent := range commit.ParentHashes {
-		pc, err := c.repo.CommitObject(parent)
-		if err != nil {
-			return nil, fmt.Errorf("%v:%.10v: %v", path, pc.Hash, err)
-		}
-		np := commitPath(path, i+1)
-		ptrac, err := c.tracCommit(np, pc)
+		i, parent := i, parent
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ctx.Err(); err != nil {
+				errs[i] = err
+				return
+			}
+			// Only the object-store read is bounded by the worker
+			// pool, not this goroutine's lifetime: tracCommit below
+			// recurses and blocks on its own wg.Wait(), and a slot
+			// held across that wait would starve the very children
+			// it's waiting on once recursion depth exceeds --jobs.
+			c.acquire()
+			pc, err := c.repo.CommitObject(parent)
+			c.release()
+			if err != nil {
+				errs[i] = fmt.Errorf("%v:%.10v: %v", path, parent, err)
+				return
+			}
+			np := commitPath(path, i+1)
+			ptrac, err := c.tracCommit(ctx, np, pc)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			parents[i] = ptrac
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
 		if err != nil {
 			return nil, err
 		}
-		trac.parents = append(trac.parents, ptrac)
 	}
+	trac.parents = parents
 
 	seenHeads := make(map[plumbing.Hash]bool)
 	seenTracs := make(map[plumbing.Hash]bool)
@@ -301,6 +665,19 @@ func equalSubs(a, b []*Trac) bool {
 // produce a synthetic trac commit that includes all parents and submodules,
 // but not the commit itself.
 func (c *Cache) newTracCommit(commit *object.Commit, tracs []*object.Commit, heads []*Trac) (*object.Commit, error) {
+	// tracs/heads are discovered by concurrent workers, so sort them by
+	// hash first: the resulting commit's hash must depend only on the
+	// content being tracked, not on the order goroutines happened to
+	// finish in.
+	tracs = append([]*object.Commit(nil), tracs...)
+	sort.Slice(tracs, func(i, j int) bool {
+		return tracs[i].Hash.String() < tracs[j].Hash.String()
+	})
+	heads = append([]*Trac(nil), heads...)
+	sort.Slice(heads, func(i, j int) bool {
+		return heads[i].hash.String() < heads[j].hash.String()
+	})
+
 	var parents []plumbing.Hash
 
 	// Inherit from our parent tracCommits
@@ -350,6 +727,81 @@ func (c *Cache) newTracCommit(commit *object.Commit, tracs []*object.Commit, hea
 	return tc, nil
 }
 
+// Push publishes all local *.trac branches (or just the given refs, if any
+// are named) to the given remote, using a refspec that maps
+// refs/heads/*.trac to refs/subtrac/* so the synthetic commits land in a
+// well-known namespace on the far side, alongside the real submodule
+// commits they parent.
+func (c *Cache) PushTracRefs(ctx context.Context, remoteName string, refs []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	remote, err := c.repo.Remote(remoteName)
+	if err != nil {
+		return fmt.Errorf("remote %v: %v", remoteName, err)
+	}
+
+	var refspecs []config.RefSpec
+	if len(refs) == 0 {
+		refspecs = append(refspecs,
+			config.RefSpec("refs/heads/*.trac:refs/subtrac/*"))
+	} else {
+		for _, refname := range refs {
+			// Accept either a short branch name ("foo") or a fully-
+			// qualified one ("refs/heads/foo"); either way src/dst are
+			// rebuilt from the bare name, same as UpdateBranchRefs does.
+			name := strings.TrimPrefix(refname, "refs/heads/")
+			src := name
+			if !strings.HasSuffix(src, ".trac") {
+				src += ".trac"
+			}
+			dst := "refs/subtrac/" + strings.TrimSuffix(src, ".trac")
+			refspecs = append(refspecs,
+				config.RefSpec(fmt.Sprintf("refs/heads/%v:%v", src, dst)))
+		}
+	}
+
+	c.info("push", Fields{"remote": remoteName,
+		"msg": fmt.Sprintf("Pushing %d trac ref(s) to %v", len(refspecs), remoteName)})
+	err = remote.PushContext(ctx, &git.PushOptions{
+		RemoteName: remoteName,
+		RefSpecs:   refspecs,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("push %v: %v", remoteName, err)
+	}
+	return nil
+}
+
+// Fetch pulls the refs/subtrac/* namespace from the given remote into the
+// same namespace locally, priming this repo's object store with the
+// synthetic trac commits (and the submodule commits they parent) so a
+// subsequent UpdateBranchRefs has nothing left to regenerate.
+func (c *Cache) FetchTracRefs(ctx context.Context, remoteName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	remote, err := c.repo.Remote(remoteName)
+	if err != nil {
+		return fmt.Errorf("remote %v: %v", remoteName, err)
+	}
+
+	refspecs := []config.RefSpec{
+		config.RefSpec("refs/subtrac/*:refs/subtrac/*"),
+	}
+
+	c.info("fetch", Fields{"remote": remoteName,
+		"msg": fmt.Sprintf("Fetching trac refs from %v", remoteName)})
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: remoteName,
+		RefSpecs:   refspecs,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("fetch %v: %v", remoteName, err)
+	}
+	return nil
+}
+
 // Update a "commit path" which represents how we get to a given commit
 // from a starting point. So if the starting point is "master^2~25, and sub is
 // 1, the result is master^2~26. If sub is 3, the result is master^2~25^3, and
@@ -375,9 +827,13 @@ func commitPath(path string, sub int) string {
 // Recursively open all submodule repositories, starting at c.repo, and
 // return a list of them.
 func (c *Cache) allSubrepos() (paths []string, repos []*git.Repository, err error) {
+	c.mu.Lock()
 	if c.srPaths != nil && c.srRepos != nil {
-		return c.srPaths, c.srRepos, nil
+		paths, repos := c.srPaths, c.srRepos
+		c.mu.Unlock()
+		return paths, repos, nil
 	}
+	c.mu.Unlock()
 
 	var recurse func(string, *git.Repository) error
 	recurse = func(path string, r *git.Repository) error {
@@ -403,7 +859,8 @@ func (c *Cache) allSubrepos() (paths []string, repos []*git.Repository, err erro
 			empty := plumbing.Hash{}
 			if ss.Current == empty {
 				// not currently initialized
-				c.infof("git submodule(%s): not initialized; skipping\n", subpath)
+				c.info("submodule_skip", Fields{"submodule": subpath,
+					"msg": fmt.Sprintf("git submodule(%s): not initialized; skipping", subpath)})
 				continue
 			}
 
@@ -426,12 +883,74 @@ func (c *Cache) allSubrepos() (paths []string, repos []*git.Repository, err erro
 		return nil, nil, err
 	}
 
-	// Cache entries for next time
+	// Cache entries for next time. Two workers can race to get here on
+	// the first call; whichever result lands is fine, they're equivalent.
+	c.mu.Lock()
 	c.srPaths = paths
 	c.srRepos = repos
+	c.mu.Unlock()
 	return paths, repos, nil
 }
 
+// Register every discovered submodule's object store as a git alternate of
+// the main repo (.git/objects/info/alternates), so repo.CommitObject can
+// resolve submodule commits directly instead of tryFetchFromSubmodules
+// re-fetching objects that are already on disk under .git/modules/*. Only
+// runs once per Cache; subsequent calls return the same result.
+func (c *Cache) registerAlternates() error {
+	c.altOnce.Do(func() {
+		c.altErr = c.doRegisterAlternates()
+	})
+	return c.altErr
+}
+
+func (c *Cache) doRegisterAlternates() error {
+	paths, _, err := c.allSubrepos()
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	altPath := filepath.Join(c.repoDir, ".git", "objects", "info", "alternates")
+	existing := make(map[string]bool)
+	if b, err := ioutil.ReadFile(altPath); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			existing[line] = true
+		}
+	}
+
+	var toAdd []string
+	for _, subpath := range paths {
+		objdir := filepath.Join(c.repoDir, ".git", "modules", subpath, "objects")
+		abs, err := filepath.Abs(objdir)
+		if err != nil {
+			return fmt.Errorf("AbsPath(%v): %v", objdir, err)
+		}
+		if !existing[abs] {
+			existing[abs] = true
+			toAdd = append(toAdd, abs)
+		}
+	}
+	if len(toAdd) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(altPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return fmt.Errorf("alternates %v: %v (try without --use-alternates)", altPath, err)
+	}
+	defer f.Close()
+	for _, abs := range toAdd {
+		c.info("alternate_add", Fields{"msg": fmt.Sprintf("Registering alternate: %v", abs)})
+		if _, err := fmt.Fprintf(f, "%s\n", abs); err != nil {
+			return fmt.Errorf("alternates %v: %v", altPath, err)
+		}
+	}
+	return nil
+}
+
 type NotPresentError struct{}
 
 var NotPresent = &NotPresentError{}
@@ -439,21 +958,27 @@ var NotPresent = &NotPresentError{}
 // Try to find a given commit object in all submodule repositories. If it
 // exists, 'git fetch' it into the main repository so we can refer to it
 // as a parent of our synthetic commits.
-func (c *Cache) tryFetchFromSubmodules(path string, hash plumbing.Hash) (*NotPresentError, error) {
-	c.infof("Searching submodules for: %v\n", path)
+func (c *Cache) tryFetchFromSubmodules(ctx context.Context, path string, hash plumbing.Hash) (*NotPresentError, error) {
+	c.info("submodule_search", Fields{"submodule": path,
+		"msg": fmt.Sprintf("Searching submodules for: %v", path)})
 	paths, repos, err := c.allSubrepos()
 	if err != nil {
 		return nil, err
 	}
 	for i := range repos {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		subpath := paths[i]
 		subr := repos[i]
 		_, err = subr.CommitObject(hash)
 		if err != nil {
-			c.infof("  ...not in %v\n", subpath)
+			c.debug("submodule_miss", Fields{"submodule": subpath,
+				"msg": fmt.Sprintf("  ...not in %v", subpath)})
 			continue
 		}
-		c.infof("  ...found! in %v\n", subpath)
+		c.info("submodule_found", Fields{"submodule": subpath, "hash": hash.String(),
+			"msg": fmt.Sprintf("  ...found! in %v", subpath)})
 		brname := fmt.Sprintf("subtrac-tmp-%v", hash)
 		brrefname := plumbing.NewBranchReferenceName(brname)
 		ref := plumbing.NewHashReference(brrefname, hash)
@@ -498,8 +1023,11 @@ func (c *Cache) tryFetchFromSubmodules(path string, hash plumbing.Hash) (*NotPre
 // Starting from a given git tree object, recursively add all its subtree
 // and submodules into the cache, returning the cache object representing
 // this tree.
-func (c *Cache) tracTree(path string, tree *object.Tree) (*Trac, error) {
-	trac := c.tracs[tree.Hash]
+func (c *Cache) tracTree(ctx context.Context, path string, tree *object.Tree) (*Trac, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	trac := c.getTrac(tree.Hash)
 	if trac != nil {
 		return trac, nil
 	}
@@ -507,61 +1035,126 @@ func (c *Cache) tracTree(path string, tree *object.Tree) (*Trac, error) {
 		name: path,
 		hash: tree.Hash,
 	}
-	for _, e := range tree.Entries {
-		if e.Mode == filemode.Submodule {
-			if c.excludes[e.Hash] {
-				// Pretend it doesn't exist; don't link to it.
-				continue
+
+	// Dispatch each entry to a worker; results are collected back into
+	// their original tree order below, so the resulting subHeads list
+	// (and thus any synthetic commit hash derived from it) doesn't
+	// depend on goroutine scheduling.
+	results := make([][]*Trac, len(tree.Entries))
+	errs := make([]error, len(tree.Entries))
+	var wg sync.WaitGroup
+	for i, e := range tree.Entries {
+		if e.Mode != filemode.Submodule && e.Mode != filemode.Dir {
+			continue
+		}
+		i, e := i, e
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ctx.Err(); err != nil {
+				errs[i] = err
+				return
 			}
-			subtrac := c.tracs[e.Hash]
-			if subtrac == nil {
-				subpath := fmt.Sprintf("%s%s@%.10v", path, e.Name, e.Hash)
-				sc, err := c.repo.CommitObject(e.Hash)
-				if err != nil {
-					npErr, err := c.tryFetchFromSubmodules(subpath, e.Hash)
-					if npErr != nil && c.autoexclude {
-						c.infof("Excluding %v\n", e.Hash)
-						c.exclude(e.Hash)
-						continue
-					}
-					if err != nil {
-						return nil, fmt.Errorf("%v (fetch it manually? or try --exclude)", err)
-					}
+			// tracTreeEntry itself acquires a worker-pool slot only
+			// around its direct object-store reads, not around the
+			// recursive tracTree/tracCommit calls it makes -- see the
+			// comment in tracCommit's parent loop.
+			results[i], errs[i] = c.tracTreeEntry(ctx, path, e)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, heads := range results {
+		trac.subHeads = append(trac.subHeads, heads...)
+	}
+
+	c.add(trac)
+	return trac, nil
+}
+
+// Resolve a single tree entry (a submodule or a subdirectory) into the list
+// of submodule heads it contributes. Split out of tracTree so each entry
+// can be handled by its own worker-pool goroutine.
+func (c *Cache) tracTreeEntry(ctx context.Context, path string, e object.TreeEntry) ([]*Trac, error) {
+	if e.Mode == filemode.Submodule {
+		if c.isExcluded(e.Hash) {
+			// Pretend it doesn't exist; don't link to it.
+			return nil, nil
+		}
+		subtrac := c.getTrac(e.Hash)
+		if subtrac == nil {
+			subpath := fmt.Sprintf("%s%s@%.10v", path, e.Name, e.Hash)
+			c.acquire()
+			sc, err := c.repo.CommitObject(e.Hash)
+			c.release()
+			if err != nil && c.useAlternates {
+				if aerr := c.registerAlternates(); aerr != nil {
+					c.info("alternates_fallback", Fields{"msg": fmt.Sprintf("alternates: %v; falling back to fetch", aerr)})
+				} else {
+					c.acquire()
+					sc, err = c.repo.CommitObject(e.Hash)
+					c.release()
 				}
-				sc, err = c.repo.CommitObject(e.Hash)
-				if err != nil {
-					return nil, fmt.Errorf("%v: %v",
-						subpath, err)
+			}
+			if err != nil {
+				npErr, err := c.tryFetchFromSubmodules(ctx, subpath, e.Hash)
+				if npErr != nil && c.autoexclude {
+					c.info("exclude", Fields{"hash": e.Hash.String(),
+						"msg": fmt.Sprintf("Excluding %v", e.Hash)})
+					c.exclude(e.Hash)
+					return nil, nil
 				}
-				subtrac, err = c.tracCommit(subpath, sc)
 				if err != nil {
-					return nil, err
+					return nil, fmt.Errorf("%v (fetch it manually? or try --exclude)", err)
 				}
 			}
-			// Add exactly one submodule.
-			// subtrac.tracCommit includes any submodules which
-			// that submodule itself depends on.
-			trac.subHeads = append(trac.subHeads, subtrac)
-		} else if e.Mode == filemode.Dir {
-			t, err := c.repo.TreeObject(e.Hash)
+			c.acquire()
+			sc, err = c.repo.CommitObject(e.Hash)
+			c.release()
 			if err != nil {
-				return nil, fmt.Errorf("%v:%.10v: %v",
-					path+e.Name, e.Hash, err)
+				return nil, fmt.Errorf("%v: %v",
+					subpath, err)
 			}
-			subtrac, err := c.tracTree(path+e.Name+"/", t)
+			// tracCommit recurses and may itself block in wg.Wait(),
+			// so it must run without holding a worker-pool slot.
+			subtrac, err = c.tracCommit(ctx, subpath, sc)
 			if err != nil {
 				return nil, err
 			}
-			// Collect the list of submodules all the way down the tree.
-			trac.subHeads = append(trac.subHeads, subtrac.subHeads...)
 		}
+		// Add exactly one submodule.
+		// subtrac.tracCommit includes any submodules which
+		// that submodule itself depends on.
+		return []*Trac{subtrac}, nil
+	} else if e.Mode == filemode.Dir {
+		c.acquire()
+		t, err := c.repo.TreeObject(e.Hash)
+		c.release()
+		if err != nil {
+			return nil, fmt.Errorf("%v:%.10v: %v",
+				path+e.Name, e.Hash, err)
+		}
+		subtrac, err := c.tracTree(ctx, path+e.Name+"/", t)
+		if err != nil {
+			return nil, err
+		}
+		// Collect the list of submodules all the way down the tree.
+		return subtrac.subHeads, nil
 	}
-	c.add(trac)
-	return trac, nil
+	return nil, nil
 }
 
 // Add a given entry into the cache.
 func (c *Cache) add(trac *Trac) {
-	c.debugf("  add %.10v %v\n", trac.hash, trac.name)
+	c.debug("trac_add", Fields{"hash": trac.hash.String(),
+		"msg": fmt.Sprintf("  add %.10v %v", trac.hash, trac.name)})
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.tracs[trac.hash] = trac
+	c.newTracs = append(c.newTracs, trac)
 }
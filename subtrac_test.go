@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=subtrac-test", "GIT_AUTHOR_EMAIL=subtrac-test@localhost",
+		"GIT_COMMITTER_NAME=subtrac-test", "GIT_COMMITTER_EMAIL=subtrac-test@localhost")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// buildSubmoduleRepo creates a fresh repo at <tmp>/main on branch "main"
+// with one initialized submodule at "sub", and returns the main repo's
+// directory and the hash of its HEAD commit (the commit that adds the
+// submodule).
+func buildSubmoduleRepo(t *testing.T) (mainDir, headHash string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	tmp := t.TempDir()
+	subDir := filepath.Join(tmp, "sub")
+	mainDir = filepath.Join(tmp, "main")
+
+	if err := os.Mkdir(subDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, subDir, "init", "-q", "-b", "main")
+	if err := ioutil.WriteFile(filepath.Join(subDir, "f.txt"), []byte("hello\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, subDir, "add", "f.txt")
+	runGit(t, subDir, "commit", "-q", "-m", "init")
+
+	if err := os.Mkdir(mainDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, mainDir, "init", "-q", "-b", "main")
+	runGit(t, mainDir, "-c", "protocol.file.allow=always", "submodule", "add", "-q", "../sub", "sub")
+	runGit(t, mainDir, "add", "-A")
+	runGit(t, mainDir, "commit", "-q", "-m", "add submodule")
+	headHash = runGit(t, mainDir, "rev-parse", "HEAD")
+
+	return mainDir, headHash
+}
+
+// TestRegisterAlternatesResolvesSubmoduleCommit exercises the concern raised
+// in review: doRegisterAlternates appends to .git/objects/info/alternates
+// after c.repo was already opened by git.PlainOpen, and go-git v4 might read
+// its alternates list only once at open time. If that were true, the write
+// would succeed but c.repo would never actually resolve objects through it --
+// a failure registerAlternates' own return value can't catch. This test
+// checks the resolution itself, not just that the right bytes got appended.
+func TestRegisterAlternatesResolvesSubmoduleCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	tmp := t.TempDir()
+	subDir := filepath.Join(tmp, "sub")
+	mainDir := filepath.Join(tmp, "main")
+
+	if err := os.Mkdir(subDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, subDir, "init", "-q", "-b", "main")
+	if err := ioutil.WriteFile(filepath.Join(subDir, "f.txt"), []byte("hello\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, subDir, "add", "f.txt")
+	runGit(t, subDir, "commit", "-q", "-m", "init")
+	subHash := runGit(t, subDir, "rev-parse", "HEAD")
+
+	if err := os.Mkdir(mainDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, mainDir, "init", "-q", "-b", "main")
+	runGit(t, mainDir, "-c", "protocol.file.allow=always", "submodule", "add", "-q", "../sub", "sub")
+	runGit(t, mainDir, "add", "-A")
+	runGit(t, mainDir, "commit", "-q", "-m", "add submodule")
+
+	r, err := git.PlainOpen(mainDir)
+	if err != nil {
+		t.Fatalf("PlainOpen: %v", err)
+	}
+
+	c, err := NewCache(context.Background(), mainDir, r, nil, false, true, 1,
+		NewTextLogger(ioutil.Discard, false))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	hash := plumbing.NewHash(subHash)
+
+	// Sanity check: before the alternate is registered, the main repo's
+	// object store genuinely doesn't contain the submodule's commit.
+	if _, err := c.repo.CommitObject(hash); err == nil {
+		t.Fatalf("submodule commit %v unexpectedly resolvable before registerAlternates", hash)
+	}
+
+	if err := c.registerAlternates(); err != nil {
+		t.Fatalf("registerAlternates: %v", err)
+	}
+
+	// The part a byte-level check of the alternates file can't see: does
+	// the *already-open* c.repo actually resolve through it now?
+	if _, err := c.repo.CommitObject(hash); err != nil {
+		t.Fatalf("submodule commit %v not resolvable via c.repo after registerAlternates: %v", hash, err)
+	}
+}
+
+// TestDiskCacheRoundTrip writes the persistent trac cache in one Cache
+// instance and confirms a second Cache, opened fresh against the same repo
+// (simulating the next invocation of the CLI), reads it back and reports
+// the same trac hash without needing anything recomputed from the live
+// tree.
+func TestDiskCacheRoundTrip(t *testing.T) {
+	mainDir, _ := buildSubmoduleRepo(t)
+	ctx := context.Background()
+	logger := NewTextLogger(ioutil.Discard, false)
+
+	r1, err := git.PlainOpen(mainDir)
+	if err != nil {
+		t.Fatalf("PlainOpen: %v", err)
+	}
+	c1, err := NewCache(ctx, mainDir, r1, nil, false, false, 2, logger)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	if err := c1.UpdateBranchRefs(ctx); err != nil {
+		t.Fatalf("UpdateBranchRefs: %v", err)
+	}
+	trac1, err := c1.TracByRef(ctx, "refs/heads/main")
+	if err != nil {
+		t.Fatalf("TracByRef: %v", err)
+	}
+	if trac1 == nil {
+		t.Fatalf("expected a submodule commit on refs/heads/main")
+	}
+	want := trac1.Hash
+	if err := c1.SaveDiskCache(); err != nil {
+		t.Fatalf("SaveDiskCache: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(c1.diskCachePath())
+	if err != nil {
+		t.Fatalf("reading disk cache: %v", err)
+	}
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if len(lines) < 2 || lines[0] != cacheHeaderPrefix {
+		t.Fatalf("disk cache %q: want header %q followed by entries, got %q", c1.diskCachePath(), cacheHeaderPrefix, lines)
+	}
+
+	r2, err := git.PlainOpen(mainDir)
+	if err != nil {
+		t.Fatalf("PlainOpen (2nd): %v", err)
+	}
+	c2, err := NewCache(ctx, mainDir, r2, nil, false, false, 2, logger)
+	if err != nil {
+		t.Fatalf("NewCache (2nd): %v", err)
+	}
+	if c2.diskCacheStale {
+		t.Fatalf("2nd Cache treated the just-written disk cache as stale")
+	}
+	trac2, err := c2.TracByRef(ctx, "refs/heads/main")
+	if err != nil {
+		t.Fatalf("TracByRef (2nd): %v", err)
+	}
+	if trac2 == nil || trac2.Hash != want {
+		t.Fatalf("2nd Cache: got %v, want %v", trac2, want)
+	}
+}
+
+// TestVerifyRefCatchesStaleTracRef confirms VerifyRef fails loudly when a
+// .trac ref doesn't match the trac commit its branch would compute today --
+// the case a CI "fail fast" gate exists to catch.
+func TestVerifyRefCatchesStaleTracRef(t *testing.T) {
+	mainDir, headHash := buildSubmoduleRepo(t)
+	ctx := context.Background()
+	logger := NewTextLogger(ioutil.Discard, false)
+
+	r, err := git.PlainOpen(mainDir)
+	if err != nil {
+		t.Fatalf("PlainOpen: %v", err)
+	}
+	c, err := NewCache(ctx, mainDir, r, nil, false, false, 2, logger)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	if err := c.UpdateBranchRefs(ctx); err != nil {
+		t.Fatalf("UpdateBranchRefs: %v", err)
+	}
+
+	if err := c.VerifyRef(ctx, "refs/heads/main", plumbing.ZeroHash); err != nil {
+		t.Fatalf("VerifyRef on a freshly-updated .trac ref: %v", err)
+	}
+
+	// Make refs/heads/main.trac stale by pointing it at main's own (real,
+	// resolvable) HEAD commit instead of the synthetic trac commit that
+	// actually matches main's current tree.
+	staleRef := plumbing.NewHashReference(
+		plumbing.ReferenceName("refs/heads/main.trac"), plumbing.NewHash(headHash))
+	if err := c.repo.Storer.SetReference(staleRef); err != nil {
+		t.Fatalf("SetReference: %v", err)
+	}
+
+	if err := c.VerifyRef(ctx, "refs/heads/main", plumbing.ZeroHash); err == nil {
+		t.Fatalf("VerifyRef did not catch a stale refs/heads/main.trac")
+	}
+}